@@ -1,34 +1,43 @@
 package collectors
 
 import (
+	"sync/atomic"
 	"time"
 
+	"github.com/cloudfoundry-community/cf_exporter/collectors/cfapi"
 	cfclient "github.com/cloudfoundry-community/go-cfclient"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/log"
-	"github.com/remeh/sizedwaitgroup"
 )
 
-const (
-	concurrentOrganizationsGoroutines = 10
-	concurrentSpacesGoroutines        = 10
-)
+// cacheResourceApplications is the resource name the applications snapshot
+// is registered and looked up under in the shared Cache.
+const cacheResourceApplications = "applications"
 
 type ApplicationsCollector struct {
-	namespace                                   string
-	environment                                 string
-	deployment                                  string
-	cfClient                                    *cfclient.Client
-	applicationInfoMetric                       *prometheus.GaugeVec
-	applicationInstancesMetric                  *prometheus.GaugeVec
-	applicationInstancesRunningMetric           *prometheus.GaugeVec
-	applicationMemoryMbMetric                   *prometheus.GaugeVec
-	applicationDiskQuotaMbMetric                *prometheus.GaugeVec
-	applicationsScrapesTotalMetric              prometheus.Counter
-	applicationsScrapeErrorsTotalMetric         prometheus.Counter
-	lastApplicationsScrapeErrorMetric           prometheus.Gauge
-	lastApplicationsScrapeTimestampMetric       prometheus.Gauge
-	lastApplicationsScrapeDurationSecondsMetric prometheus.Gauge
+	namespace            string
+	environment          string
+	deployment           string
+	apiClient            *cfapi.Client
+	cache                *Cache
+	includeOrganizations []string
+	excludeOrganizations []string
+	includeSpaces        []string
+	excludeSpaces        []string
+
+	applicationInfoDesc                       *prometheus.Desc
+	applicationInstancesDesc                  *prometheus.Desc
+	applicationInstancesRunningDesc           *prometheus.Desc
+	applicationMemoryMbDesc                   *prometheus.Desc
+	applicationDiskQuotaMbDesc                *prometheus.Desc
+	applicationsScrapesTotalDesc              *prometheus.Desc
+	applicationsScrapeErrorsTotalDesc         *prometheus.Desc
+	lastApplicationsScrapeErrorDesc           *prometheus.Desc
+	lastApplicationsScrapeTimestampDesc       *prometheus.Desc
+	lastApplicationsScrapeDurationSecondsDesc *prometheus.Desc
+
+	scrapesTotal      uint64
+	scrapeErrorsTotal uint64
 }
 
 type application struct {
@@ -63,280 +72,210 @@ func newApplication(
 	}
 }
 
-var (
-	appCache      = []*application(nil)
-	appErrorCache = error(nil)
-)
-
+// NewApplicationsCollector wires up an ApplicationsCollector against
+// apiClient, which callers should construct once per process with
+// cfapi.NewClient and share across every collector that talks to the Cloud
+// Foundry API - a cfapi.Client owns a rate limiter and a set of Prometheus
+// vectors, and both stop doing their job (or collide on registration) if
+// each collector builds its own.
 func NewApplicationsCollector(
 	namespace string,
 	environment string,
 	deployment string,
-	cfClient *cfclient.Client,
+	apiClient *cfapi.Client,
+	cache *Cache,
+	includeOrganizations []string,
+	excludeOrganizations []string,
+	includeSpaces []string,
+	excludeSpaces []string,
 ) *ApplicationsCollector {
-	applicationInfoMetric := prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Namespace:   namespace,
-			Subsystem:   "application",
-			Name:        "info",
-			Help:        "Labeled Cloud Foundry Application information with a constant '1' value.",
-			ConstLabels: prometheus.Labels{"environment": environment, "deployment": deployment},
-		},
-		[]string{"application_id", "application_name", "detected_buildpack", "buildpack", "organization_id", "organization_name", "space_id", "space_name", "stack_id", "state"},
+	constLabels := prometheus.Labels{"environment": environment, "deployment": deployment}
+
+	applicationInfoDesc := prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "application", "info"),
+		"Labeled Cloud Foundry Application information with a constant '1' value.",
+		[]string{"application_id", "application_name", "detected_buildpack", "buildpack", "organization_id", "organization_name", "space_id", "space_name", "stack_name", "state"},
+		constLabels,
 	)
 
-	applicationInstancesMetric := prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Namespace:   namespace,
-			Subsystem:   "application",
-			Name:        "instances",
-			Help:        "Number of desired Cloud Foundry Application Instances.",
-			ConstLabels: prometheus.Labels{"environment": environment, "deployment": deployment},
-		},
+	applicationInstancesDesc := prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "application", "instances"),
+		"Number of desired Cloud Foundry Application Instances.",
 		[]string{"application_id", "application_name", "organization_id", "organization_name", "space_id", "space_name", "state"},
+		constLabels,
 	)
 
-	applicationInstancesRunningMetric := prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Namespace:   namespace,
-			Subsystem:   "application",
-			Name:        "instances_running",
-			Help:        "Number of running Cloud Foundry Application Instances.",
-			ConstLabels: prometheus.Labels{"environment": environment, "deployment": deployment},
-		},
+	applicationInstancesRunningDesc := prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "application", "instances_running"),
+		"Number of running Cloud Foundry Application Instances.",
 		[]string{"application_id", "application_name", "organization_id", "organization_name", "space_id", "space_name", "state"},
+		constLabels,
 	)
 
-	applicationMemoryMbMetric := prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Namespace:   namespace,
-			Subsystem:   "application",
-			Name:        "memory_mb",
-			Help:        "Cloud Foundry Application Memory (Mb).",
-			ConstLabels: prometheus.Labels{"environment": environment, "deployment": deployment},
-		},
+	applicationMemoryMbDesc := prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "application", "memory_mb"),
+		"Cloud Foundry Application Memory (Mb).",
 		[]string{"application_id", "application_name", "organization_id", "organization_name", "space_id", "space_name"},
+		constLabels,
 	)
 
-	applicationDiskQuotaMbMetric := prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Namespace:   namespace,
-			Subsystem:   "application",
-			Name:        "disk_quota_mb",
-			Help:        "Cloud Foundry Application Disk Quota (Mb).",
-			ConstLabels: prometheus.Labels{"environment": environment, "deployment": deployment},
-		},
+	applicationDiskQuotaMbDesc := prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "application", "disk_quota_mb"),
+		"Cloud Foundry Application Disk Quota (Mb).",
 		[]string{"application_id", "application_name", "organization_id", "organization_name", "space_id", "space_name"},
+		constLabels,
 	)
 
-	applicationsScrapesTotalMetric := prometheus.NewCounter(
-		prometheus.CounterOpts{
-			Namespace:   namespace,
-			Subsystem:   "applications_scrapes",
-			Name:        "total",
-			Help:        "Total number of scrapes for Cloud Foundry Applications.",
-			ConstLabels: prometheus.Labels{"environment": environment, "deployment": deployment},
-		},
+	applicationsScrapesTotalDesc := prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "applications_scrapes", "total"),
+		"Total number of scrapes for Cloud Foundry Applications.",
+		nil,
+		constLabels,
 	)
 
-	applicationsScrapeErrorsTotalMetric := prometheus.NewCounter(
-		prometheus.CounterOpts{
-			Namespace:   namespace,
-			Subsystem:   "applications_scrape_errors",
-			Name:        "total",
-			Help:        "Total number of scrape errors of Cloud Foundry Applications.",
-			ConstLabels: prometheus.Labels{"environment": environment, "deployment": deployment},
-		},
+	applicationsScrapeErrorsTotalDesc := prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "applications_scrape_errors", "total"),
+		"Total number of scrape errors of Cloud Foundry Applications.",
+		nil,
+		constLabels,
 	)
 
-	lastApplicationsScrapeErrorMetric := prometheus.NewGauge(
-		prometheus.GaugeOpts{
-			Namespace:   namespace,
-			Subsystem:   "",
-			Name:        "last_applications_scrape_error",
-			Help:        "Whether the last scrape of Applications metrics from Cloud Foundry resulted in an error (1 for error, 0 for success).",
-			ConstLabels: prometheus.Labels{"environment": environment, "deployment": deployment},
-		},
+	lastApplicationsScrapeErrorDesc := prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "last_applications_scrape_error"),
+		"Whether the last scrape of Applications metrics from Cloud Foundry resulted in an error (1 for error, 0 for success).",
+		nil,
+		constLabels,
 	)
 
-	lastApplicationsScrapeTimestampMetric := prometheus.NewGauge(
-		prometheus.GaugeOpts{
-			Namespace:   namespace,
-			Subsystem:   "",
-			Name:        "last_applications_scrape_timestamp",
-			Help:        "Number of seconds since 1970 since last scrape of Applications metrics from Cloud Foundry.",
-			ConstLabels: prometheus.Labels{"environment": environment, "deployment": deployment},
-		},
+	lastApplicationsScrapeTimestampDesc := prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "last_applications_scrape_timestamp"),
+		"Number of seconds since 1970 since last scrape of Applications metrics from Cloud Foundry.",
+		nil,
+		constLabels,
 	)
 
-	lastApplicationsScrapeDurationSecondsMetric := prometheus.NewGauge(
-		prometheus.GaugeOpts{
-			Namespace:   namespace,
-			Subsystem:   "",
-			Name:        "last_applications_scrape_duration_seconds",
-			Help:        "Duration of the last scrape of Applications metrics from Cloud Foundry.",
-			ConstLabels: prometheus.Labels{"environment": environment, "deployment": deployment},
-		},
+	lastApplicationsScrapeDurationSecondsDesc := prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "last_applications_scrape_duration_seconds"),
+		"Duration of the last scrape of Applications metrics from Cloud Foundry.",
+		nil,
+		constLabels,
 	)
 
 	c := &ApplicationsCollector{
-		namespace:                                   namespace,
-		environment:                                 environment,
-		deployment:                                  deployment,
-		cfClient:                                    cfClient,
-		applicationInfoMetric:                       applicationInfoMetric,
-		applicationInstancesMetric:                  applicationInstancesMetric,
-		applicationInstancesRunningMetric:           applicationInstancesRunningMetric,
-		applicationMemoryMbMetric:                   applicationMemoryMbMetric,
-		applicationDiskQuotaMbMetric:                applicationDiskQuotaMbMetric,
-		applicationsScrapesTotalMetric:              applicationsScrapesTotalMetric,
-		applicationsScrapeErrorsTotalMetric:         applicationsScrapeErrorsTotalMetric,
-		lastApplicationsScrapeErrorMetric:           lastApplicationsScrapeErrorMetric,
-		lastApplicationsScrapeTimestampMetric:       lastApplicationsScrapeTimestampMetric,
-		lastApplicationsScrapeDurationSecondsMetric: lastApplicationsScrapeDurationSecondsMetric,
+		namespace:            namespace,
+		environment:          environment,
+		deployment:           deployment,
+		apiClient:            apiClient,
+		cache:                cache,
+		includeOrganizations: includeOrganizations,
+		excludeOrganizations: excludeOrganizations,
+		includeSpaces:        includeSpaces,
+		excludeSpaces:        excludeSpaces,
+
+		applicationInfoDesc:                       applicationInfoDesc,
+		applicationInstancesDesc:                  applicationInstancesDesc,
+		applicationInstancesRunningDesc:           applicationInstancesRunningDesc,
+		applicationMemoryMbDesc:                   applicationMemoryMbDesc,
+		applicationDiskQuotaMbDesc:                applicationDiskQuotaMbDesc,
+		applicationsScrapesTotalDesc:              applicationsScrapesTotalDesc,
+		applicationsScrapeErrorsTotalDesc:         applicationsScrapeErrorsTotalDesc,
+		lastApplicationsScrapeErrorDesc:           lastApplicationsScrapeErrorDesc,
+		lastApplicationsScrapeTimestampDesc:       lastApplicationsScrapeTimestampDesc,
+		lastApplicationsScrapeDurationSecondsDesc: lastApplicationsScrapeDurationSecondsDesc,
 	}
 
-	c.appSchedule(300 * time.Second)
+	c.cache.Register(cacheResourceApplications, *cacheApplicationsInterval, *cacheStaleIfError, c.getApplicationMetrics)
+
+	V3Registry.Register(V3GroupApplications, c)
 
 	return c
 }
 
-func (c ApplicationsCollector) Collect(ch chan<- prometheus.Metric) {
+// Collect emits every observation as a prometheus.MustNewConstMetric
+// directly to ch instead of mutating GaugeVecs held on the struct. This
+// means a scrape no longer needs to Reset() shared vector state - which
+// raced with the background cache refresher repopulating it - and no
+// longer pays for the map allocations a GaugeVec needs to track label
+// combinations across scrapes.
+func (c *ApplicationsCollector) Collect(ch chan<- prometheus.Metric) {
 	var begun = time.Now()
 
 	errorMetric := float64(0)
 	if err := c.reportApplicationsMetrics(ch); err != nil {
 		errorMetric = float64(1)
-		c.applicationsScrapeErrorsTotalMetric.Inc()
+		atomic.AddUint64(&c.scrapeErrorsTotal, 1)
 	}
-	c.applicationsScrapeErrorsTotalMetric.Collect(ch)
+	ch <- prometheus.MustNewConstMetric(c.applicationsScrapeErrorsTotalDesc, prometheus.CounterValue, float64(atomic.LoadUint64(&c.scrapeErrorsTotal)))
 
-	c.applicationsScrapesTotalMetric.Inc()
-	c.applicationsScrapesTotalMetric.Collect(ch)
+	atomic.AddUint64(&c.scrapesTotal, 1)
+	ch <- prometheus.MustNewConstMetric(c.applicationsScrapesTotalDesc, prometheus.CounterValue, float64(atomic.LoadUint64(&c.scrapesTotal)))
 
-	c.lastApplicationsScrapeErrorMetric.Set(errorMetric)
-	c.lastApplicationsScrapeErrorMetric.Collect(ch)
-
-	c.lastApplicationsScrapeTimestampMetric.Set(float64(time.Now().Unix()))
-	c.lastApplicationsScrapeTimestampMetric.Collect(ch)
-
-	c.lastApplicationsScrapeDurationSecondsMetric.Set(time.Since(begun).Seconds())
-	c.lastApplicationsScrapeDurationSecondsMetric.Collect(ch)
+	ch <- prometheus.MustNewConstMetric(c.lastApplicationsScrapeErrorDesc, prometheus.GaugeValue, errorMetric)
+	ch <- prometheus.MustNewConstMetric(c.lastApplicationsScrapeTimestampDesc, prometheus.GaugeValue, float64(time.Now().Unix()))
+	ch <- prometheus.MustNewConstMetric(c.lastApplicationsScrapeDurationSecondsDesc, prometheus.GaugeValue, time.Since(begun).Seconds())
 }
 
-func (c ApplicationsCollector) Describe(ch chan<- *prometheus.Desc) {
-	c.applicationInfoMetric.Describe(ch)
-	c.applicationInstancesMetric.Describe(ch)
-	c.applicationInstancesRunningMetric.Describe(ch)
-	c.applicationMemoryMbMetric.Describe(ch)
-	c.applicationDiskQuotaMbMetric.Describe(ch)
-	c.applicationsScrapesTotalMetric.Describe(ch)
-	c.applicationsScrapeErrorsTotalMetric.Describe(ch)
-	c.lastApplicationsScrapeErrorMetric.Describe(ch)
-	c.lastApplicationsScrapeTimestampMetric.Describe(ch)
-	c.lastApplicationsScrapeDurationSecondsMetric.Describe(ch)
+func (c *ApplicationsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.applicationInfoDesc
+	ch <- c.applicationInstancesDesc
+	ch <- c.applicationInstancesRunningDesc
+	ch <- c.applicationMemoryMbDesc
+	ch <- c.applicationDiskQuotaMbDesc
+	ch <- c.applicationsScrapesTotalDesc
+	ch <- c.applicationsScrapeErrorsTotalDesc
+	ch <- c.lastApplicationsScrapeErrorDesc
+	ch <- c.lastApplicationsScrapeTimestampDesc
+	ch <- c.lastApplicationsScrapeDurationSecondsDesc
 }
 
-func (c ApplicationsCollector) reportApplicationsMetrics(ch chan<- prometheus.Metric) error {
-	c.applicationInfoMetric.Reset()
-	c.applicationInstancesMetric.Reset()
-	c.applicationInstancesRunningMetric.Reset()
-	c.applicationMemoryMbMetric.Reset()
-	c.applicationDiskQuotaMbMetric.Reset()
-
-	c.loadFromCache(appCache)
-
-	err := appErrorCache
-
+// reportApplicationsMetrics reads strictly from the shared Cache and never
+// calls out to the Cloud Foundry API itself, so a slow or unreachable API
+// can no longer turn into a blocked, timed-out Prometheus scrape.
+func (c *ApplicationsCollector) reportApplicationsMetrics(ch chan<- prometheus.Metric) error {
+	cached, err := c.cache.Get(cacheResourceApplications)
 	if err != nil {
-		log.Errorf("Error while listing organization: %v", err)
+		log.Errorf("Error while reading applications from cache: %v", err)
 		return err
 	}
 
-	c.applicationInfoMetric.Collect(ch)
-	c.applicationInstancesMetric.Collect(ch)
-	c.applicationInstancesRunningMetric.Collect(ch)
-	c.applicationMemoryMbMetric.Collect(ch)
-	c.applicationDiskQuotaMbMetric.Collect(ch)
+	applications, _ := cached.([]*application)
+	c.emitApplications(ch, applications)
 
 	return nil
 }
 
-func (c ApplicationsCollector) getApplicationMetrics() error {
+// getApplicationMetrics loads applications through the v3 API, scoped to
+// whatever organizations/spaces the collector was configured to include or
+// exclude. This replaces the previous `ListOrgs` -> `OrgSpaces` ->
+// `space.Summary()` fanout, which issued one request per organization and
+// per space even when an operator only cared about a handful of them. It is
+// registered with the shared Cache and runs on a background ticker rather
+// than inline during a scrape.
+func (c *ApplicationsCollector) getApplicationMetrics() (interface{}, error) {
 	log.Info("Scraping...")
 
-	organizations, err := c.cfClient.ListOrgs()
-	if err != nil {
-		log.Errorf("Error while listing organization: %v", err)
-	}
-
-	wg := sizedwaitgroup.New(concurrentOrganizationsGoroutines)
-	errChannel := make(chan error, len(organizations))
-
-	for _, organization := range organizations {
-		wg.Add()
-		go func(organization cfclient.Org) {
-			defer wg.Done()
-
-			err := c.getOrgSpaces(organization)
-			if err != nil {
-				errChannel <- err
-			}
-		}(organization)
+	loader := &v3AppsLoader{
+		apiClient:            c.apiClient,
+		includeOrganizations: c.includeOrganizations,
+		excludeOrganizations: c.excludeOrganizations,
+		includeSpaces:        c.includeSpaces,
+		excludeSpaces:        c.excludeSpaces,
 	}
 
-	wg.Wait()
-	close(errChannel)
-
-	return <-errChannel
-}
-
-func (c ApplicationsCollector) getOrgSpaces(organization cfclient.Org) error {
-	spaces, err := c.cfClient.OrgSpaces(organization.Guid)
-	if err != nil {
-		log.Errorf("Error while listing spaces for organization `%s`: %v", organization.Guid, err)
-		return err
-	}
-
-	wg := sizedwaitgroup.New(concurrentSpacesGoroutines)
-	errChannel := make(chan error, len(spaces))
-
-	for _, space := range spaces {
-		wg.Add()
-		go func(space cfclient.Space) {
-			defer wg.Done()
-
-			err := c.getSpaceSummary(organization, space)
-			if err != nil {
-				errChannel <- err
-			}
-		}(space)
-	}
-
-	wg.Wait()
-	close(errChannel)
-
-	return <-errChannel
-}
-
-func (c ApplicationsCollector) getSpaceSummary(organization cfclient.Org, space cfclient.Space) error {
-	spaceSummary, err := space.Summary()
+	applications, err := loader.load()
 	if err != nil {
-		log.Errorf("Error while getting summary for space `%s`: %v", space.Guid, err)
-		return err
-	}
-
-	tc := appCache
-	for _, application := range spaceSummary.Apps {
-		thisApp := newApplication(application, space, organization)
-		tc = append(tc, thisApp)
+		log.Errorf("Error while listing applications: %v", err)
+		return nil, err
 	}
-	appCache = tc
 
-	return nil
+	return applications, nil
 }
 
-func (c ApplicationsCollector) loadFromCache(ca []*application) {
+// emitApplications writes a MustNewConstMetric per application, per metric,
+// straight to ch. Unlike the GaugeVec.WithLabelValues approach this
+// replaced, it allocates no long-lived label-value maps and never races
+// with a concurrent refresh of the underlying cache entry.
+func (c *ApplicationsCollector) emitApplications(ch chan<- prometheus.Metric, ca []*application) {
 	for _, app := range ca {
 		application := app.app
 		detectedBuildpack := app.detectedBuildpack
@@ -344,7 +283,10 @@ func (c ApplicationsCollector) loadFromCache(ca []*application) {
 		organization := app.org
 		space := app.space
 
-		c.applicationInfoMetric.WithLabelValues(
+		ch <- prometheus.MustNewConstMetric(
+			c.applicationInfoDesc,
+			prometheus.GaugeValue,
+			float64(1),
 			application.Guid,
 			application.Name,
 			detectedBuildpack,
@@ -355,9 +297,12 @@ func (c ApplicationsCollector) loadFromCache(ca []*application) {
 			space.Name,
 			application.StackGuid,
 			application.State,
-		).Set(float64(1))
+		)
 
-		c.applicationInstancesMetric.WithLabelValues(
+		ch <- prometheus.MustNewConstMetric(
+			c.applicationInstancesDesc,
+			prometheus.GaugeValue,
+			float64(application.Instances),
 			application.Guid,
 			application.Name,
 			organization.Guid,
@@ -365,9 +310,12 @@ func (c ApplicationsCollector) loadFromCache(ca []*application) {
 			space.Guid,
 			space.Name,
 			application.State,
-		).Set(float64(application.Instances))
+		)
 
-		c.applicationInstancesRunningMetric.WithLabelValues(
+		ch <- prometheus.MustNewConstMetric(
+			c.applicationInstancesRunningDesc,
+			prometheus.GaugeValue,
+			float64(application.RunningInstances),
 			application.Guid,
 			application.Name,
 			organization.Guid,
@@ -375,24 +323,30 @@ func (c ApplicationsCollector) loadFromCache(ca []*application) {
 			space.Guid,
 			space.Name,
 			application.State,
-		).Set(float64(application.RunningInstances))
+		)
 
-		c.applicationMemoryMbMetric.WithLabelValues(
+		ch <- prometheus.MustNewConstMetric(
+			c.applicationMemoryMbDesc,
+			prometheus.GaugeValue,
+			float64(application.Memory),
 			application.Guid,
 			application.Name,
 			organization.Guid,
 			organization.Name,
 			space.Guid,
 			space.Name,
-		).Set(float64(application.Memory))
+		)
 
-		c.applicationDiskQuotaMbMetric.WithLabelValues(
+		ch <- prometheus.MustNewConstMetric(
+			c.applicationDiskQuotaMbDesc,
+			prometheus.GaugeValue,
+			float64(application.DiskQuota),
 			application.Guid,
 			application.Name,
 			organization.Guid,
 			organization.Name,
 			space.Guid,
 			space.Name,
-		).Set(float64(application.DiskQuota))
+		)
 	}
 }
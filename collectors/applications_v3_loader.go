@@ -0,0 +1,785 @@
+package collectors
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/cloudfoundry-community/cf_exporter/collectors/cfapi"
+	cfclient "github.com/cloudfoundry-community/go-cfclient"
+	"github.com/prometheus/common/log"
+)
+
+const applicationsV3PerPage = 100
+
+// applicationsV3GuidBatchSize bounds how many GUIDs go into a single
+// `organization_guids`/`space_guids`/`app_guids` query parameter, so a large
+// include list - or, for app_guids, a large foundation's full app count -
+// can't build a query string CF's web server rejects for exceeding its URL
+// length limit.
+const applicationsV3GuidBatchSize = 50
+
+// runningInstancesMaxApps bounds how many applications fetchRunningInstances
+// fans out `/v3/processes/:guid/stats` requests for per refresh: CF v3 has
+// no bulk stats endpoint, so this is one request per application, and doing
+// that unbounded would turn a single refresh of a large foundation into
+// thousands of serialized requests at the shared `--cf.rate-limit`. Beyond
+// the limit, enrichApplications falls back to the desired instance count
+// for running instances rather than leaving it unmeasured forever.
+var runningInstancesMaxApps = kingpin.Flag(
+	"cf.running-instances-max-apps", "Maximum number of applications to fetch measured running-instance counts for via /v3/processes/:guid/stats per refresh. Applications beyond this limit report their desired instance count instead of a measured one.",
+).Default("2000").Int()
+
+// chunkGuids splits guids into chunks of at most applicationsV3GuidBatchSize
+// GUIDs, or a single nil chunk when guids itself is empty, so callers can
+// range over the result unconditionally whether or not a filter is in
+// effect.
+func chunkGuids(guids []string) [][]string {
+	if len(guids) == 0 {
+		return [][]string{nil}
+	}
+
+	var chunks [][]string
+	for len(guids) > applicationsV3GuidBatchSize {
+		chunks = append(chunks, guids[:applicationsV3GuidBatchSize])
+		guids = guids[applicationsV3GuidBatchSize:]
+	}
+
+	return append(chunks, guids)
+}
+
+// v3AppsLoader fetches applications through the CF v3 API, pushing org/space
+// scoping down to the API itself (`organization_guids`, `space_guids`)
+// instead of fanning out over every organization and space and calling
+// `space.Summary()` for each one. Every request goes through a cfapi.Client
+// so that rate limiting, retry/backoff and request instrumentation apply
+// uniformly, and pages beyond the first are fetched through its prefetching
+// Paginator.
+type v3AppsLoader struct {
+	apiClient *cfapi.Client
+
+	includeOrganizations []string
+	excludeOrganizations []string
+	includeSpaces        []string
+	excludeSpaces        []string
+}
+
+// v3Resource is the subset of the CF v3 "resource" envelope shared by every
+// list endpoint we read from (apps, organizations, spaces).
+type v3Resource struct {
+	Guid string `json:"guid"`
+	Name string `json:"name"`
+}
+
+type v3Pagination struct {
+	TotalPages int `json:"total_pages"`
+}
+
+type v3AppRelationships struct {
+	Space struct {
+		Data v3Resource `json:"data"`
+	} `json:"space"`
+}
+
+type v3App struct {
+	Guid      string `json:"guid"`
+	Name      string `json:"name"`
+	State     string `json:"state"`
+	Lifecycle struct {
+		Data struct {
+			Buildpacks []string `json:"buildpacks"`
+		} `json:"data"`
+	} `json:"lifecycle"`
+	Relationships v3AppRelationships `json:"relationships"`
+}
+
+// v3AppRelationship is the `relationships.app.data.guid` shape shared by the
+// process and droplet resources, joining each back to the application it
+// belongs to.
+type v3AppRelationship struct {
+	App struct {
+		Data v3Resource `json:"data"`
+	} `json:"app"`
+}
+
+// v3Process is a process resource from `/v3/processes`, read for the
+// instance count, memory and disk figures that `/v3/apps` itself doesn't
+// carry - in v3 those moved from the app onto its processes.
+type v3Process struct {
+	Guid          string            `json:"guid"`
+	Type          string            `json:"type"`
+	Instances     int               `json:"instances"`
+	MemoryInMb    int               `json:"memory_in_mb"`
+	DiskInMb      int               `json:"disk_in_mb"`
+	Relationships v3AppRelationship `json:"relationships"`
+}
+
+type v3ProcessesPage struct {
+	Pagination v3Pagination `json:"pagination"`
+	Resources  []v3Process  `json:"resources"`
+}
+
+// v3ProcessStats is the per-instance health from
+// `/v3/processes/:guid/stats`, used to count how many of a process's
+// instances are actually RUNNING.
+type v3ProcessStats struct {
+	Resources []struct {
+		State string `json:"state"`
+	} `json:"resources"`
+}
+
+// v3Droplet is the app's current droplet from `/v3/droplets`, the only
+// place v3 exposes the buildpack CF actually detected and staged with -
+// `lifecycle.data.buildpacks` on the app is what was requested, not what
+// ran - and the stack it was staged against.
+type v3Droplet struct {
+	Guid       string `json:"guid"`
+	Stack      string `json:"stack"`
+	Buildpacks []struct {
+		Name         string `json:"name"`
+		DetectOutput string `json:"detect_output"`
+	} `json:"buildpacks"`
+	Relationships v3AppRelationship `json:"relationships"`
+}
+
+type v3DropletsPage struct {
+	Pagination v3Pagination `json:"pagination"`
+	Resources  []v3Droplet  `json:"resources"`
+}
+
+// v3Space is a space resource from the `included` block of `/v3/apps?
+// include=space.organization`, with the space->organization relationship
+// needed to join each application to its organization.
+type v3Space struct {
+	v3Resource
+	Relationships struct {
+		Organization struct {
+			Data v3Resource `json:"data"`
+		} `json:"organization"`
+	} `json:"relationships"`
+}
+
+type v3Included struct {
+	Spaces        []v3Space    `json:"spaces"`
+	Organizations []v3Resource `json:"organizations"`
+}
+
+type v3AppsPage struct {
+	Pagination v3Pagination `json:"pagination"`
+	Resources  []v3App      `json:"resources"`
+	Included   v3Included   `json:"included"`
+}
+
+// load resolves the configured include/exclude org/space names to GUIDs,
+// then walks `/v3/apps` with `organization_guids`/`space_guids` applied
+// server-side, joining each application's space and organization from the
+// `included` block rather than issuing a `space.Summary()` call per space.
+func (l *v3AppsLoader) load() ([]*application, error) {
+	// A cancelable ctx, not context.Background() on its own: every Pages
+	// caller in this file must own one so that returning early (including
+	// on a decode error, which Pages itself has no visibility into) always
+	// cancels in-flight and queued page fetches instead of leaking their
+	// goroutines blocked on an abandoned result channel.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	organizationGuids, err := l.resolveGuids(ctx, "organizations", "/v3/organizations", l.includeOrganizations, l.excludeOrganizations)
+	if err != nil {
+		return nil, err
+	}
+	if organizationGuids != nil && len(organizationGuids) == 0 {
+		// A filter is in effect (an include name, or an exclude-everything)
+		// and it matched nothing - scope to nothing rather than falling
+		// through to an unfiltered `/v3/apps` that would scrape everything.
+		return nil, nil
+	}
+
+	spaceGuids, err := l.resolveGuids(ctx, "spaces", "/v3/spaces", l.includeSpaces, l.excludeSpaces)
+	if err != nil {
+		return nil, err
+	}
+	if spaceGuids != nil && len(spaceGuids) == 0 {
+		return nil, nil
+	}
+
+	// organizationGuids/spaceGuids are chunked separately and combined, not
+	// just each chunked on its own, because /v3/apps applies both filters
+	// together (AND semantics) - a batch must pair one chunk of each so no
+	// matching application is skipped.
+	var applications []*application
+	for _, organizationGuidsBatch := range chunkGuids(organizationGuids) {
+		for _, spaceGuidsBatch := range chunkGuids(spaceGuids) {
+			batch, err := l.fetchApps(ctx, organizationGuidsBatch, spaceGuidsBatch)
+			if err != nil {
+				return nil, err
+			}
+
+			applications = append(applications, batch...)
+		}
+	}
+
+	if err := l.enrichApplications(ctx, applications); err != nil {
+		return nil, err
+	}
+
+	return applications, nil
+}
+
+// fetchApps walks every `/v3/apps` page scoped to one (organizationGuids,
+// spaceGuids) batch, already bounded to applicationsV3GuidBatchSize GUIDs
+// each by the caller.
+func (l *v3AppsLoader) fetchApps(ctx context.Context, organizationGuids []string, spaceGuids []string) ([]*application, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	pathForPage := func(page int) string {
+		return appsPagePath(page, organizationGuids, spaceGuids)
+	}
+
+	first, err := l.fetchPage(ctx, pathForPage(1))
+	if err != nil {
+		return nil, err
+	}
+
+	applications := l.applicationsFromPage(first)
+
+	for result := range l.apiClient.Pages(ctx, "apps", pathForPage, 2, first.Pagination.TotalPages) {
+		if result.Err != nil {
+			return nil, result.Err
+		}
+
+		page, err := decodeAppsPage(result.Resp)
+		if err != nil {
+			return nil, err
+		}
+
+		applications = append(applications, l.applicationsFromPage(page)...)
+	}
+
+	return applications, nil
+}
+
+// enrichApplications fills in the process and droplet data `/v3/apps`
+// itself doesn't carry: desired/running instances, memory and disk quota
+// from each application's "web" process, and the detected buildpack and
+// stack from its current droplet. It batches both lookups by app GUID
+// across the whole result set rather than per page: each costs one
+// `/v3/processes` and one `/v3/droplets` fetch (plus pagination) per
+// applicationsV3GuidBatchSize applications, however the apps were paged.
+func (l *v3AppsLoader) enrichApplications(ctx context.Context, applications []*application) error {
+	if len(applications) == 0 {
+		return nil
+	}
+
+	appGuids := make([]string, len(applications))
+	for i, app := range applications {
+		appGuids[i] = app.app.Guid
+	}
+
+	processesByAppGuid, err := l.fetchProcesses(ctx, appGuids)
+	if err != nil {
+		return err
+	}
+
+	runningInstancesByAppGuid, err := l.fetchRunningInstances(ctx, processesByAppGuid)
+	if err != nil {
+		return err
+	}
+
+	dropletsByAppGuid, err := l.fetchCurrentDroplets(ctx, appGuids)
+	if err != nil {
+		return err
+	}
+
+	for i, app := range applications {
+		summary := app.app
+
+		if process, ok := processesByAppGuid[summary.Guid]; ok {
+			summary.Instances = process.Instances
+			summary.Memory = process.MemoryInMb
+			summary.DiskQuota = process.DiskInMb
+		}
+		if running, ok := runningInstancesByAppGuid[summary.Guid]; ok {
+			summary.RunningInstances = running
+		} else {
+			summary.RunningInstances = summary.Instances
+		}
+
+		if droplet, ok := dropletsByAppGuid[summary.Guid]; ok {
+			// StackGuid is a v2-era field name on AppSummary; v3 droplets
+			// expose the stack by name, not GUID, and that's what feeds the
+			// application_info metric's stack_name label.
+			summary.StackGuid = droplet.Stack
+			if len(droplet.Buildpacks) > 0 {
+				detected := droplet.Buildpacks[0].DetectOutput
+				if detected == "" {
+					detected = droplet.Buildpacks[0].Name
+				}
+				summary.DetectedBuildpack = detected
+			}
+		}
+
+		applications[i] = newApplication(summary, app.space, app.org)
+	}
+
+	return nil
+}
+
+// fetchProcesses bulk-fetches the "web" process of every app in appGuids via
+// `/v3/processes?app_guids=...`, keyed by application GUID, the same
+// push-down-filtering approach appsPagePath uses for organizations/spaces -
+// one paginated request per batch instead of one per app. appGuids is split
+// into applicationsV3GuidBatchSize-sized chunks first, since a large enough
+// foundation would otherwise build an app_guids query string CF's web server
+// rejects for exceeding its URL length limit.
+func (l *v3AppsLoader) fetchProcesses(ctx context.Context, appGuids []string) (map[string]v3Process, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	processesByAppGuid := make(map[string]v3Process, len(appGuids))
+	for _, batch := range chunkGuids(appGuids) {
+		if err := l.fetchProcessesBatch(ctx, batch, processesByAppGuid); err != nil {
+			return nil, err
+		}
+	}
+
+	return processesByAppGuid, nil
+}
+
+// fetchProcessesBatch fetches every page of `/v3/processes` for one batch of
+// app GUIDs, merging results into processesByAppGuid.
+func (l *v3AppsLoader) fetchProcessesBatch(ctx context.Context, appGuids []string, processesByAppGuid map[string]v3Process) error {
+	pathForPage := func(page int) string {
+		query := url.Values{}
+		query.Set("app_guids", strings.Join(appGuids, ","))
+		query.Set("types", "web")
+		query.Set("page", fmt.Sprintf("%d", page))
+		query.Set("per_page", fmt.Sprintf("%d", applicationsV3PerPage))
+		return "/v3/processes?" + query.Encode()
+	}
+
+	resp, err := l.apiClient.Get(ctx, "processes", pathForPage(1))
+	if err != nil {
+		log.Errorf("Error while listing processes: %v", err)
+		return err
+	}
+
+	var first v3ProcessesPage
+	if err := json.NewDecoder(resp.Body).Decode(&first); err != nil {
+		resp.Body.Close()
+		log.Errorf("Error while decoding processes: %v", err)
+		return err
+	}
+	resp.Body.Close()
+
+	for _, process := range first.Resources {
+		processesByAppGuid[process.Relationships.App.Data.Guid] = process
+	}
+
+	for result := range l.apiClient.Pages(ctx, "processes", pathForPage, 2, first.Pagination.TotalPages) {
+		if result.Err != nil {
+			return result.Err
+		}
+
+		var page v3ProcessesPage
+		err := json.NewDecoder(result.Resp.Body).Decode(&page)
+		result.Resp.Body.Close()
+		if err != nil {
+			log.Errorf("Error while decoding processes: %v", err)
+			return err
+		}
+
+		for _, process := range page.Resources {
+			processesByAppGuid[process.Relationships.App.Data.Guid] = process
+		}
+	}
+
+	return nil
+}
+
+// fetchCurrentDroplets bulk-fetches the current droplet of every app in
+// appGuids via `/v3/droplets?app_guids=...&current=true`, keyed by
+// application GUID. appGuids is split into applicationsV3GuidBatchSize-sized
+// chunks first, for the same URL-length reason as fetchProcesses.
+func (l *v3AppsLoader) fetchCurrentDroplets(ctx context.Context, appGuids []string) (map[string]v3Droplet, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	dropletsByAppGuid := make(map[string]v3Droplet, len(appGuids))
+	for _, batch := range chunkGuids(appGuids) {
+		if err := l.fetchCurrentDropletsBatch(ctx, batch, dropletsByAppGuid); err != nil {
+			return nil, err
+		}
+	}
+
+	return dropletsByAppGuid, nil
+}
+
+// fetchCurrentDropletsBatch fetches every page of `/v3/droplets` for one
+// batch of app GUIDs, merging results into dropletsByAppGuid.
+func (l *v3AppsLoader) fetchCurrentDropletsBatch(ctx context.Context, appGuids []string, dropletsByAppGuid map[string]v3Droplet) error {
+	pathForPage := func(page int) string {
+		query := url.Values{}
+		query.Set("app_guids", strings.Join(appGuids, ","))
+		query.Set("current", "true")
+		query.Set("page", fmt.Sprintf("%d", page))
+		query.Set("per_page", fmt.Sprintf("%d", applicationsV3PerPage))
+		return "/v3/droplets?" + query.Encode()
+	}
+
+	resp, err := l.apiClient.Get(ctx, "droplets", pathForPage(1))
+	if err != nil {
+		log.Errorf("Error while listing droplets: %v", err)
+		return err
+	}
+
+	var first v3DropletsPage
+	if err := json.NewDecoder(resp.Body).Decode(&first); err != nil {
+		resp.Body.Close()
+		log.Errorf("Error while decoding droplets: %v", err)
+		return err
+	}
+	resp.Body.Close()
+
+	for _, droplet := range first.Resources {
+		dropletsByAppGuid[droplet.Relationships.App.Data.Guid] = droplet
+	}
+
+	for result := range l.apiClient.Pages(ctx, "droplets", pathForPage, 2, first.Pagination.TotalPages) {
+		if result.Err != nil {
+			return result.Err
+		}
+
+		var page v3DropletsPage
+		err := json.NewDecoder(result.Resp.Body).Decode(&page)
+		result.Resp.Body.Close()
+		if err != nil {
+			log.Errorf("Error while decoding droplets: %v", err)
+			return err
+		}
+
+		for _, droplet := range page.Resources {
+			dropletsByAppGuid[droplet.Relationships.App.Data.Guid] = droplet
+		}
+	}
+
+	return nil
+}
+
+// fetchRunningInstances counts, per application, how many of its "web"
+// process's instances report RUNNING. CF v3 has no bulk stats endpoint -
+// `/v3/processes/:guid/stats` is per-process - so this fans out one request
+// per process. It reuses cfapi.Client.Pages for that fan-out: Pages only
+// cares that pathForPage maps an int in range to a request path, so a
+// synthetic "page per process" range gets the same bounded concurrency,
+// rate limiting and retry/backoff as a real paginated listing.
+//
+// That fan-out is still one request per application, so it's capped at
+// runningInstancesMaxApps: left unbounded, a large foundation would turn
+// every refresh into thousands of serialized requests at the shared
+// --cf.rate-limit, the exact "minutes, not seconds" scrape this loader's
+// push-down filtering was meant to get away from. Applications beyond the
+// cap are simply absent from the returned map; enrichApplications falls
+// back to each one's desired instance count.
+func (l *v3AppsLoader) fetchRunningInstances(ctx context.Context, processesByAppGuid map[string]v3Process) (map[string]int, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	appGuids := make([]string, 0, len(processesByAppGuid))
+	for appGuid := range processesByAppGuid {
+		appGuids = append(appGuids, appGuid)
+	}
+	if len(appGuids) == 0 {
+		return nil, nil
+	}
+
+	if len(appGuids) > *runningInstancesMaxApps {
+		log.Errorf("%d applications exceed --cf.running-instances-max-apps=%d; reporting their desired instance count instead of a measured running count", len(appGuids)-*runningInstancesMaxApps, *runningInstancesMaxApps)
+		appGuids = appGuids[:*runningInstancesMaxApps]
+	}
+
+	pathForPage := func(i int) string {
+		return "/v3/processes/" + processesByAppGuid[appGuids[i]].Guid + "/stats"
+	}
+
+	runningInstancesByAppGuid := make(map[string]int, len(appGuids))
+	for result := range l.apiClient.Pages(ctx, "process_stats", pathForPage, 0, len(appGuids)-1) {
+		if result.Err != nil {
+			return nil, result.Err
+		}
+
+		var stats v3ProcessStats
+		err := json.NewDecoder(result.Resp.Body).Decode(&stats)
+		result.Resp.Body.Close()
+		if err != nil {
+			log.Errorf("Error while decoding process stats: %v", err)
+			return nil, err
+		}
+
+		running := 0
+		for _, instance := range stats.Resources {
+			if instance.State == "RUNNING" {
+				running++
+			}
+		}
+		runningInstancesByAppGuid[appGuids[result.Page]] = running
+	}
+
+	return runningInstancesByAppGuid, nil
+}
+
+// appsPagePath builds the `/v3/apps` query string for a single page, scoped
+// to the given organization/space GUIDs and including `space.organization`
+// so the join can happen client-side without extra requests.
+func appsPagePath(page int, organizationGuids []string, spaceGuids []string) string {
+	query := url.Values{}
+	query.Set("page", fmt.Sprintf("%d", page))
+	query.Set("per_page", fmt.Sprintf("%d", applicationsV3PerPage))
+	query.Set("include", "space.organization")
+	if len(organizationGuids) > 0 {
+		query.Set("organization_guids", strings.Join(organizationGuids, ","))
+	}
+	if len(spaceGuids) > 0 {
+		query.Set("space_guids", strings.Join(spaceGuids, ","))
+	}
+
+	return "/v3/apps?" + query.Encode()
+}
+
+// fetchPage requests and decodes a single page of `/v3/apps`.
+func (l *v3AppsLoader) fetchPage(ctx context.Context, path string) (*v3AppsPage, error) {
+	resp, err := l.apiClient.Get(ctx, "apps", path)
+	if err != nil {
+		log.Errorf("Error while listing applications: %v", err)
+		return nil, err
+	}
+
+	return decodeAppsPage(resp)
+}
+
+// decodeAppsPage decodes and closes the body of a `/v3/apps` response.
+func decodeAppsPage(resp *http.Response) (*v3AppsPage, error) {
+	defer resp.Body.Close()
+
+	var decoded v3AppsPage
+	if err := json.NewDecoder(resp.Body).Decode(&decoded); err != nil {
+		log.Errorf("Error while decoding applications: %v", err)
+		return nil, err
+	}
+
+	return &decoded, nil
+}
+
+// applicationsFromPage joins each application on that page with the space
+// and organization resources CF returned in the `included` block, via the
+// space's own `relationships.organization` - the organizations `included`
+// block is keyed by organization GUID, not space GUID. Process
+// (instances/memory/disk) and droplet (detected buildpack/stack) data isn't
+// available here - `/v3/apps` doesn't carry it - and is filled in
+// afterwards by enrichApplications across the whole result set.
+func (l *v3AppsLoader) applicationsFromPage(page *v3AppsPage) []*application {
+	spacesByGuid := make(map[string]v3Space, len(page.Included.Spaces))
+	for _, space := range page.Included.Spaces {
+		spacesByGuid[space.Guid] = space
+	}
+
+	organizationsByGuid := make(map[string]v3Resource, len(page.Included.Organizations))
+	for _, organization := range page.Included.Organizations {
+		organizationsByGuid[organization.Guid] = organization
+	}
+
+	applications := make([]*application, 0, len(page.Resources))
+	for _, app := range page.Resources {
+		space := spacesByGuid[app.Relationships.Space.Data.Guid]
+
+		appSummary := cfclient.AppSummary{
+			Guid:  app.Guid,
+			Name:  app.Name,
+			State: app.State,
+		}
+		if len(app.Lifecycle.Data.Buildpacks) > 0 {
+			appSummary.Buildpack = app.Lifecycle.Data.Buildpacks[0]
+		}
+
+		cfSpace := cfclient.Space{Guid: space.Guid, Name: space.Name}
+		cfOrg := cfclient.Org{}
+		if organization, ok := organizationsByGuid[space.Relationships.Organization.Data.Guid]; ok {
+			cfOrg = cfclient.Org{Guid: organization.Guid, Name: organization.Name}
+		}
+
+		applications = append(applications, newApplication(appSummary, cfSpace, cfOrg))
+	}
+
+	return applications
+}
+
+// resolveGuids turns the configured include/exclude organization/space names
+// and GUIDs into a list of GUIDs suitable for the
+// `organization_guids`/`space_guids` query parameters, looking up any bare
+// names against `path`. Excludes apply whether or not an include was given:
+// with no include, every resource from `path` is a candidate and exclude
+// narrows it down. The return value distinguishes "no filter configured"
+// (nil) from "a filter is configured and matched nothing" (a non-nil, zero
+// length slice) - callers must scope to nothing in the latter case, since
+// passing an empty GUID list through to CF's query parameters does not mean
+// the same thing as omitting it.
+func (l *v3AppsLoader) resolveGuids(ctx context.Context, endpoint string, path string, include []string, exclude []string) ([]string, error) {
+	if len(include) == 0 && len(exclude) == 0 {
+		return nil, nil
+	}
+
+	excludedSet := map[string]bool{}
+	if len(exclude) > 0 {
+		excluded, err := l.resolveNamesOrGuids(ctx, endpoint, path, exclude)
+		if err != nil {
+			return nil, err
+		}
+		for _, guid := range excluded {
+			excludedSet[guid] = true
+		}
+	}
+
+	var candidates []string
+	if len(include) > 0 {
+		included, err := l.resolveNamesOrGuids(ctx, endpoint, path, include)
+		if err != nil {
+			return nil, err
+		}
+		candidates = included
+	} else {
+		all, err := l.listAllGuids(ctx, endpoint, path)
+		if err != nil {
+			return nil, err
+		}
+		candidates = all
+	}
+
+	guids := make([]string, 0, len(candidates))
+	for _, guid := range candidates {
+		if !excludedSet[guid] {
+			guids = append(guids, guid)
+		}
+	}
+
+	return guids, nil
+}
+
+// listAllGuids lists every resource GUID at path, with no name filter
+// applied, so that an exclude-only configuration has a full candidate set
+// to exclude from.
+func (l *v3AppsLoader) listAllGuids(ctx context.Context, endpoint string, path string) ([]string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	query := url.Values{}
+	query.Set("per_page", fmt.Sprintf("%d", applicationsV3PerPage))
+
+	resp, err := l.apiClient.Get(ctx, endpoint, path+"?"+query.Encode())
+	if err != nil {
+		log.Errorf("Error while listing `%s`: %v", path, err)
+		return nil, err
+	}
+
+	var first struct {
+		Pagination v3Pagination `json:"pagination"`
+		Resources  []v3Resource `json:"resources"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&first); err != nil {
+		resp.Body.Close()
+		log.Errorf("Error while decoding `%s`: %v", path, err)
+		return nil, err
+	}
+	resp.Body.Close()
+
+	guids := make([]string, 0, len(first.Resources))
+	for _, resource := range first.Resources {
+		guids = append(guids, resource.Guid)
+	}
+
+	pathForPage := func(page int) string {
+		q := url.Values{}
+		q.Set("per_page", fmt.Sprintf("%d", applicationsV3PerPage))
+		q.Set("page", fmt.Sprintf("%d", page))
+		return path + "?" + q.Encode()
+	}
+
+	for result := range l.apiClient.Pages(ctx, endpoint, pathForPage, 2, first.Pagination.TotalPages) {
+		if result.Err != nil {
+			return nil, result.Err
+		}
+
+		var page struct {
+			Resources []v3Resource `json:"resources"`
+		}
+		if err := json.NewDecoder(result.Resp.Body).Decode(&page); err != nil {
+			result.Resp.Body.Close()
+			log.Errorf("Error while decoding `%s`: %v", path, err)
+			return nil, err
+		}
+		result.Resp.Body.Close()
+
+		for _, resource := range page.Resources {
+			guids = append(guids, resource.Guid)
+		}
+	}
+
+	return guids, nil
+}
+
+// resolveNamesOrGuids looks up the GUID for any entry in `values` that does
+// not already look like a GUID, via a single `names=` request to `path`.
+func (l *v3AppsLoader) resolveNamesOrGuids(ctx context.Context, endpoint string, path string, values []string) ([]string, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	var names []string
+	guids := make([]string, 0, len(values))
+	for _, value := range values {
+		if looksLikeGuid(value) {
+			guids = append(guids, value)
+		} else {
+			names = append(names, value)
+		}
+	}
+
+	if len(names) == 0 {
+		return guids, nil
+	}
+
+	query := url.Values{}
+	query.Set("names", strings.Join(names, ","))
+	query.Set("per_page", fmt.Sprintf("%d", applicationsV3PerPage))
+
+	resp, err := l.apiClient.Get(ctx, endpoint, path+"?"+query.Encode())
+	if err != nil {
+		log.Errorf("Error while resolving `%s` names %v: %v", path, names, err)
+		return nil, err
+	}
+
+	var decoded struct {
+		Resources []v3Resource `json:"resources"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&decoded); err != nil {
+		resp.Body.Close()
+		log.Errorf("Error while decoding `%s` names %v: %v", path, names, err)
+		return nil, err
+	}
+	resp.Body.Close()
+
+	for _, resource := range decoded.Resources {
+		guids = append(guids, resource.Guid)
+	}
+
+	return guids, nil
+}
+
+// looksLikeGuid reports whether value has the dashed, 36-character shape of
+// a CF GUID rather than a resource name.
+func looksLikeGuid(value string) bool {
+	return len(value) == 36 && strings.Count(value, "-") == 4
+}
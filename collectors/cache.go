@@ -0,0 +1,144 @@
+package collectors
+
+import (
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+var (
+	cacheApplicationsInterval = kingpin.Flag(
+		"cache.applications.interval", "Interval at which the applications cache is refreshed in the background.",
+	).Default("300s").Duration()
+
+	cacheStaleIfError = kingpin.Flag(
+		"cache.stale-if-error", "How long a cache entry keeps serving its last good snapshot after a background refresh fails.",
+	).Default("30m").Duration()
+)
+
+// cacheEntry holds the last known-good snapshot for a resource, plus
+// bookkeeping used to decide whether a failed refresh should still be
+// served (stale-if-error) or surfaced as an error.
+type cacheEntry struct {
+	data         interface{}
+	err          error
+	lastRefresh  time.Time
+	lastSuccess  time.Time
+	staleIfError time.Duration
+}
+
+// Cache is a background-refreshed, RWMutex-protected store keyed by
+// resource name (e.g. "applications", "orgs"). Collectors read from it via
+// Get, which never blocks on the Cloud Foundry API: refreshes happen on a
+// ticker in a dedicated goroutine per resource, started by Register.
+//
+// This replaces the package-level `appCache`/`appErrorCache` variables that
+// were mutated from concurrent `getSpaceSummary` goroutines with no
+// synchronization, and the `appSchedule` call that had no corresponding
+// definition.
+type Cache struct {
+	mu      sync.RWMutex
+	entries map[string]*cacheEntry
+
+	cacheAgeSecondsDesc *prometheus.Desc
+}
+
+// NewCache creates an empty Cache and the `cf_exporter_cache_age_seconds`
+// gauge used to report how long ago each resource last refreshed
+// successfully, so operators can alert on stale data.
+func NewCache(namespace string) *Cache {
+	return &Cache{
+		entries: make(map[string]*cacheEntry),
+		cacheAgeSecondsDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "cache", "age_seconds"),
+			"Number of seconds since the cached resource last refreshed successfully.",
+			[]string{"resource"},
+			nil,
+		),
+	}
+}
+
+// Register starts a background goroutine that calls refresh every interval
+// and stores its result under resource. The first refresh runs
+// synchronously so that Get has data to serve as soon as Register returns.
+// If a refresh returns an error and the last successful snapshot is younger
+// than staleIfError, the stale snapshot keeps being served instead of the
+// error.
+func (c *Cache) Register(resource string, interval time.Duration, staleIfError time.Duration, refresh func() (interface{}, error)) {
+	c.mu.Lock()
+	entry := &cacheEntry{staleIfError: staleIfError}
+	c.entries[resource] = entry
+	c.mu.Unlock()
+
+	c.refresh(resource, entry, refresh)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			c.refresh(resource, entry, refresh)
+		}
+	}()
+}
+
+// refresh runs a single refresh cycle for resource and updates its entry,
+// applying the stale-if-error policy on failure.
+func (c *Cache) refresh(resource string, entry *cacheEntry, refresh func() (interface{}, error)) {
+	data, err := refresh()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry.lastRefresh = time.Now()
+
+	if err != nil {
+		if entry.lastSuccess.IsZero() || time.Since(entry.lastSuccess) > entry.staleIfError {
+			log.Errorf("Error refreshing `%s` cache, no fresh-enough snapshot to fall back on: %v", resource, err)
+			entry.err = err
+		} else {
+			log.Errorf("Error refreshing `%s` cache, serving last good snapshot from %s: %v", resource, entry.lastSuccess, err)
+		}
+		return
+	}
+
+	entry.data = data
+	entry.err = nil
+	entry.lastSuccess = entry.lastRefresh
+}
+
+// Get returns the last known-good snapshot for resource, and the error from
+// the most recent refresh if no snapshot is fresh enough to serve.
+func (c *Cache) Get(resource string) (interface{}, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	entry, ok := c.entries[resource]
+	if !ok {
+		return nil, nil
+	}
+
+	return entry.data, entry.err
+}
+
+// Describe implements prometheus.Collector.
+func (c *Cache) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.cacheAgeSecondsDesc
+}
+
+// Collect implements prometheus.Collector, reporting how long ago each
+// registered resource last refreshed successfully.
+func (c *Cache) Collect(ch chan<- prometheus.Metric) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	for resource, entry := range c.entries {
+		if entry.lastSuccess.IsZero() {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(c.cacheAgeSecondsDesc, prometheus.GaugeValue, time.Since(entry.lastSuccess).Seconds(), resource)
+	}
+}
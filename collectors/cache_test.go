@@ -0,0 +1,73 @@
+package collectors
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestCacheServesStaleSnapshotWithinWindow exercises the stale-if-error
+// policy: a refresh that fails within staleIfError of the last success
+// should keep serving that last good snapshot rather than surfacing the
+// error.
+func TestCacheServesStaleSnapshotWithinWindow(t *testing.T) {
+	cache := NewCache("test")
+
+	calls := 0
+	failing := errors.New("refresh failed")
+	refresh := func() (interface{}, error) {
+		calls++
+		if calls == 1 {
+			return "first snapshot", nil
+		}
+		return nil, failing
+	}
+
+	// A long interval keeps Register's background ticker from firing during
+	// the test; refresh is instead driven directly below for determinism.
+	cache.Register("widgets", time.Hour, time.Hour, refresh)
+
+	entry := cache.entries["widgets"]
+	if entry == nil {
+		t.Fatalf("expected Register to create an entry for `widgets`")
+	}
+
+	cache.refresh("widgets", entry, refresh)
+
+	data, err := cache.Get("widgets")
+	if err != nil {
+		t.Fatalf("expected the stale snapshot to be served without error, got %v", err)
+	}
+	if data != "first snapshot" {
+		t.Fatalf("expected the last good snapshot to still be served, got %v", data)
+	}
+}
+
+// TestCacheSurfacesErrorOnceStale confirms the other side of the policy:
+// once the last good snapshot has outlived staleIfError, a failing refresh
+// surfaces its error instead of quietly keeping the old snapshot fresh.
+func TestCacheSurfacesErrorOnceStale(t *testing.T) {
+	cache := NewCache("test")
+
+	calls := 0
+	failing := errors.New("refresh failed")
+	refresh := func() (interface{}, error) {
+		calls++
+		if calls == 1 {
+			return "first snapshot", nil
+		}
+		return nil, failing
+	}
+
+	cache.Register("widgets", time.Hour, time.Millisecond, refresh)
+
+	entry := cache.entries["widgets"]
+	entry.lastSuccess = time.Now().Add(-time.Hour)
+
+	cache.refresh("widgets", entry, refresh)
+
+	_, err := cache.Get("widgets")
+	if err != failing {
+		t.Fatalf("expected the refresh error once the stale snapshot outlived staleIfError, got %v", err)
+	}
+}
@@ -0,0 +1,171 @@
+// Package cfapi wraps cfclient.Client with the cross-cutting concerns every
+// collector in this exporter otherwise had to reimplement: a rate limiter
+// shared across all of them, retry with backoff on throttling/server
+// errors, and request instrumentation. Routing every collector through one
+// Client means a burst of collectors starting up together can't DDoS the
+// Cloud Foundry API, a well-known operational failure mode of polling every
+// resource independently.
+package cfapi
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	cfclient "github.com/cloudfoundry-community/go-cfclient"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"golang.org/x/time/rate"
+)
+
+const (
+	maxRetries     = 5
+	initialBackoff = 500 * time.Millisecond
+	maxBackoff     = 30 * time.Second
+)
+
+// rateLimit is the sustained request rate (req/s) shared by every
+// collector that routes through a cfapi.Client, so that a burst of
+// collectors starting up together cannot overwhelm the Cloud Foundry API.
+var rateLimit = kingpin.Flag(
+	"cf.rate-limit", "Maximum sustained rate, in requests per second, of Cloud Foundry API requests issued across all collectors.",
+).Default("10").Float64()
+
+// Client wraps a cfclient.Client with a shared rate limiter, retry/backoff
+// on 429/5xx responses, and Prometheus instrumentation. Collectors should
+// route every Cloud Foundry API call through it rather than calling
+// cfClient.DoRequest directly.
+type Client struct {
+	cfClient *cfclient.Client
+	limiter  *rate.Limiter
+
+	requestsTotalMetric   *prometheus.CounterVec
+	requestDurationMetric *prometheus.HistogramVec
+}
+
+// NewClient wraps cfClient with a token-bucket limiter sized from the
+// `--cf.rate-limit` flag (bursting up to one more request than that rate),
+// and builds the `cf_api_requests_total`/`cf_api_request_duration_seconds`
+// instrumentation under namespace. It registers nothing itself: the Client
+// is a prometheus.Collector, exposing that instrumentation once registered.
+func NewClient(namespace string, cfClient *cfclient.Client) *Client {
+	c := &Client{
+		cfClient: cfClient,
+		limiter:  rate.NewLimiter(rate.Limit(*rateLimit), int(*rateLimit)+1),
+		requestsTotalMetric: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: "api",
+				Name:      "requests_total",
+				Help:      "Total number of Cloud Foundry API requests made, by endpoint and status code.",
+			},
+			[]string{"endpoint", "code"},
+		),
+		requestDurationMetric: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: namespace,
+				Subsystem: "api",
+				Name:      "request_duration_seconds",
+				Help:      "Duration of Cloud Foundry API requests, by endpoint.",
+			},
+			[]string{"endpoint"},
+		),
+	}
+
+	return c
+}
+
+// Describe implements prometheus.Collector so that the exporter can expose
+// API call instrumentation alongside every other metric.
+func (c *Client) Describe(ch chan<- *prometheus.Desc) {
+	c.requestsTotalMetric.Describe(ch)
+	c.requestDurationMetric.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (c *Client) Collect(ch chan<- prometheus.Metric) {
+	c.requestsTotalMetric.Collect(ch)
+	c.requestDurationMetric.Collect(ch)
+}
+
+// Get issues a rate-limited GET to path (which may include a query string),
+// retrying on 429/5xx with exponential backoff and jitter, and recording
+// per-endpoint instrumentation. It cannot honor a `Retry-After` header: on a
+// non-2xx response, go-cfclient's DoRequest hands back a
+// cfclient.CloudFoundryHTTPError with no response attached, so the header is
+// never reachable here.
+func (c *Client) Get(ctx context.Context, endpoint string, path string) (*http.Response, error) {
+	backoff := initialBackoff
+	var lastErr error
+
+	for attempt := 0; attempt <= maxRetries; attempt++ {
+		if err := c.limiter.Wait(ctx); err != nil {
+			return nil, err
+		}
+
+		begun := time.Now()
+		req := c.cfClient.NewRequest("GET", path)
+		resp, err := c.cfClient.DoRequest(req)
+		c.requestDurationMetric.WithLabelValues(endpoint).Observe(time.Since(begun).Seconds())
+
+		code, retryable := classifyError(resp, err)
+		c.requestsTotalMetric.WithLabelValues(endpoint, code).Inc()
+
+		if err == nil {
+			return resp, nil
+		}
+		lastErr = err
+
+		if !retryable || attempt == maxRetries {
+			return nil, err
+		}
+
+		wait := jitter(backoff)
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+
+		log.Errorf("Cloud Foundry API request to `%s` failed (%s), retrying in %s (attempt %d/%d)", path, code, wait, attempt+1, maxRetries)
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	return nil, lastErr
+}
+
+// classifyError derives the instrumentation label and retry eligibility for
+// a DoRequest result. go-cfclient returns a non-nil error - a
+// cfclient.CloudFoundryHTTPError carrying the response status - for any
+// non-2xx response rather than a nil error with the status left on resp, so
+// shouldRetry must inspect the error, not r.StatusCode.
+func classifyError(resp *http.Response, err error) (code string, retryable bool) {
+	if err == nil {
+		return strconv.Itoa(resp.StatusCode), false
+	}
+
+	if httpErr, ok := err.(cfclient.CloudFoundryHTTPError); ok {
+		return strconv.Itoa(httpErr.StatusCode), shouldRetry(httpErr.StatusCode)
+	}
+
+	return "error", false
+}
+
+// shouldRetry reports whether a response status code warrants a retry:
+// rate limiting (429) or a server-side error (5xx).
+func shouldRetry(code int) bool {
+	return code == http.StatusTooManyRequests || code >= 500
+}
+
+// jitter randomizes a backoff duration by +/-50% so that many collectors
+// retrying at once don't all land on the CF API at the same instant.
+func jitter(d time.Duration) time.Duration {
+	return d/2 + time.Duration(rand.Int63n(int64(d)))
+}
@@ -0,0 +1,86 @@
+package cfapi
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+// pageFetchConcurrency bounds how many pages Pages fetches at once, so a
+// foundation with hundreds of pages scrapes in roughly (pages /
+// pageFetchConcurrency) round-trips instead of one per page, without
+// overwhelming the shared rate limiter with an unbounded fan-out.
+const pageFetchConcurrency = 5
+
+// PageResult is a single page of a paginated v3 endpoint, as delivered by
+// Pages.
+type PageResult struct {
+	Page int
+	Resp *http.Response
+	Err  error
+}
+
+// Pages walks a v3 paginated endpoint from firstPage through lastPage
+// (inclusive) using a bounded pool of pageFetchConcurrency concurrent
+// fetchers, all still going through Get so rate limiting, retry and
+// instrumentation apply uniformly. Results arrive on the returned channel as
+// they complete, not necessarily in page order - callers are expected to
+// aggregate results rather than depend on their order. On the first Get
+// error, in-flight and not-yet-started fetches are cancelled so Pages
+// doesn't keep working once the caller has what it needs to stop.
+//
+// Pages only ever cancels on its own on a Get error - it has no way to know
+// a caller stopped consuming the result channel for some other reason (a
+// decode error, say). Callers MUST therefore pass a ctx they derived
+// themselves with context.WithCancel and defer its cancel func, so that
+// returning early for any reason also stops Pages' workers rather than
+// leaking them blocked forever on a full, unread result channel.
+func (c *Client) Pages(ctx context.Context, endpoint string, pathForPage func(page int) string, firstPage int, lastPage int) <-chan PageResult {
+	out := make(chan PageResult, pageFetchConcurrency)
+	ctx, cancel := context.WithCancel(ctx)
+
+	go func() {
+		defer close(out)
+		defer cancel()
+
+		pages := make(chan int)
+		go func() {
+			defer close(pages)
+			for page := firstPage; page <= lastPage; page++ {
+				select {
+				case pages <- page:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+
+		var failOnce sync.Once
+		var wg sync.WaitGroup
+		for i := 0; i < pageFetchConcurrency; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				for page := range pages {
+					resp, err := c.Get(ctx, endpoint, pathForPage(page))
+
+					select {
+					case out <- PageResult{Page: page, Resp: resp, Err: err}:
+					case <-ctx.Done():
+						return
+					}
+
+					if err != nil {
+						failOnce.Do(cancel)
+						return
+					}
+				}
+			}()
+		}
+
+		wg.Wait()
+	}()
+
+	return out
+}
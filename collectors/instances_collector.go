@@ -0,0 +1,489 @@
+package collectors
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"strconv"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
+	"github.com/alecthomas/kingpin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+var (
+	firehoseRlpAddress = kingpin.Flag(
+		"firehose.rlp-address", "Address (host:port) of the loggregator v2 Reverse Log Proxy to stream instance metrics from.",
+	).Default("").String()
+
+	firehoseCertFile = kingpin.Flag(
+		"firehose.cert-file", "Path to the client TLS certificate used to authenticate against the Reverse Log Proxy.",
+	).Default("").String()
+
+	firehoseKeyFile = kingpin.Flag(
+		"firehose.key-file", "Path to the client TLS key used to authenticate against the Reverse Log Proxy.",
+	).Default("").String()
+
+	firehoseCAFile = kingpin.Flag(
+		"firehose.ca-file", "Path to the CA certificate used to verify the Reverse Log Proxy.",
+	).Default("").String()
+
+	firehoseShardID = kingpin.Flag(
+		"firehose.shard-id", "Shard ID to use when subscribing to the firehose, so that multiple exporter replicas can split the stream between them.",
+	).Default("cf_exporter").String()
+
+	instancesWindow = kingpin.Flag(
+		"instances.window", "How long an instance is kept in the instances cache after its last envelope, before it is considered gone.",
+	).Default("60s").Duration()
+)
+
+// instanceSnapshot is the latest known state of a single application
+// instance, as derived from the most recent loggregator v2 envelope seen
+// for it.
+type instanceSnapshot struct {
+	applicationID    string
+	instanceIndex    string
+	organizationName string
+	spaceName        string
+	cpuPercentage    float64
+	memoryBytes      float64
+	diskBytes        float64
+	state            string
+	lastSeen         time.Time
+}
+
+// InstancesCollector subscribes to the Cloud Foundry loggregator v2 Reverse
+// Log Proxy firehose and derives per-instance gauges from the envelopes it
+// receives, rather than polling. It keeps a rolling window of the latest
+// envelope per (application, instance) and drops entries that stop
+// receiving envelopes, so a crashed or evacuated instance disappears from
+// the metrics instead of reporting stale data forever. Instance state comes
+// from two sources: the firehose itself (a gauge means RUNNING, an
+// "app.crash" event means CRASHED), and the shared applications Cache, which
+// seeds a STARTING placeholder for every desired instance the firehose
+// hasn't reported on yet.
+type InstancesCollector struct {
+	namespace   string
+	environment string
+	deployment  string
+	window      time.Duration
+	cache       *Cache
+
+	mu        sync.RWMutex
+	instances map[string]*instanceSnapshot
+
+	applicationInstanceCPUPercentageDesc *prometheus.Desc
+	applicationInstanceMemoryBytesDesc   *prometheus.Desc
+	applicationInstanceDiskBytesDesc     *prometheus.Desc
+	applicationInstanceStateDesc         *prometheus.Desc
+}
+
+// NewInstancesCollector creates an InstancesCollector, registers it under
+// V3GroupInstances so it's included in /metrics/v3, and starts the
+// background goroutines that stream from the firehose, expire stale
+// instances and seed STARTING placeholders. If no RLP address is
+// configured, the collector still reports its (empty) metrics but never
+// starts streaming. cache is the same shared Cache an ApplicationsCollector
+// reads from - loggregator v2 envelopes carry neither an application's
+// organization/space names nor its instance state, so both are looked up
+// from the cached application snapshot instead.
+func NewInstancesCollector(
+	namespace string,
+	environment string,
+	deployment string,
+	cache *Cache,
+) *InstancesCollector {
+	constLabels := prometheus.Labels{"environment": environment, "deployment": deployment}
+
+	applicationInstanceCPUPercentageDesc := prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "application_instance", "cpu_percentage"),
+		"Cloud Foundry Application Instance CPU Percentage.",
+		[]string{"application_id", "instance_index", "organization_name", "space_name"},
+		constLabels,
+	)
+
+	applicationInstanceMemoryBytesDesc := prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "application_instance", "memory_bytes"),
+		"Cloud Foundry Application Instance Memory (Bytes).",
+		[]string{"application_id", "instance_index", "organization_name", "space_name"},
+		constLabels,
+	)
+
+	applicationInstanceDiskBytesDesc := prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "application_instance", "disk_bytes"),
+		"Cloud Foundry Application Instance Disk (Bytes).",
+		[]string{"application_id", "instance_index", "organization_name", "space_name"},
+		constLabels,
+	)
+
+	applicationInstanceStateDesc := prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "application_instance", "state"),
+		"Labeled Cloud Foundry Application Instance state with a constant '1' value.",
+		[]string{"application_id", "instance_index", "organization_name", "space_name", "state"},
+		constLabels,
+	)
+
+	c := &InstancesCollector{
+		namespace:                            namespace,
+		environment:                          environment,
+		deployment:                           deployment,
+		window:                               *instancesWindow,
+		cache:                                cache,
+		instances:                            make(map[string]*instanceSnapshot),
+		applicationInstanceCPUPercentageDesc: applicationInstanceCPUPercentageDesc,
+		applicationInstanceMemoryBytesDesc:   applicationInstanceMemoryBytesDesc,
+		applicationInstanceDiskBytesDesc:     applicationInstanceDiskBytesDesc,
+		applicationInstanceStateDesc:         applicationInstanceStateDesc,
+	}
+
+	if *firehoseRlpAddress != "" {
+		go c.stream()
+	}
+	go c.expireStaleInstances()
+	go c.reconcileDesiredInstances()
+
+	V3Registry.Register(V3GroupInstances, c)
+
+	return c
+}
+
+// stream connects to the Reverse Log Proxy and feeds every envelope it
+// receives into the rolling window. It runs for the lifetime of the
+// process, reconnecting on error.
+func (c *InstancesCollector) stream() {
+	for {
+		if err := c.streamOnce(); err != nil {
+			log.Errorf("Error while streaming from the firehose: %v", err)
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
+
+// streamOnce dials the Reverse Log Proxy over mTLS and consumes its
+// BatchedReceiver stream of gauge and event envelopes until the stream ends
+// or errors, at which point the caller reconnects. Gauge envelopes carry the
+// CPU/memory/disk metrics; event envelopes are the only firehose signal for
+// an instance crashing (an "app.crash" event), since gauges never carry
+// instance state.
+func (c *InstancesCollector) streamOnce() error {
+	tlsConfig, err := rlpClientTLSConfig(*firehoseCAFile, *firehoseCertFile, *firehoseKeyFile)
+	if err != nil {
+		return err
+	}
+
+	conn, err := grpc.Dial(*firehoseRlpAddress, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	client := loggregator_v2.NewEgressClient(conn)
+
+	receiver, err := client.BatchedReceiver(context.Background(), &loggregator_v2.EgressBatchRequest{
+		ShardId: *firehoseShardID,
+		Selectors: []*loggregator_v2.Selector{
+			{Message: &loggregator_v2.Selector_Gauge{Gauge: &loggregator_v2.GaugeSelector{}}},
+			{Message: &loggregator_v2.Selector_Event{Event: &loggregator_v2.EventSelector{}}},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	for {
+		batch, err := receiver.Recv()
+		if err != nil {
+			return err
+		}
+		for _, envelope := range batch.GetBatch() {
+			c.observe(envelope)
+		}
+	}
+}
+
+// rlpClientTLSConfig builds the mTLS config used to authenticate against
+// the Reverse Log Proxy, which requires a client certificate in addition to
+// trusting its CA.
+func rlpClientTLSConfig(caFile string, certFile string, keyFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	caCert, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	caCertPool := x509.NewCertPool()
+	caCertPool.AppendCertsFromPEM(caCert)
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      caCertPool,
+	}, nil
+}
+
+// observe routes a single loggregator v2 envelope to the handler for its
+// kind, if it describes an application instance.
+func (c *InstancesCollector) observe(envelope *loggregator_v2.Envelope) {
+	applicationID := envelope.GetSourceId()
+	instanceIndex := envelope.GetInstanceId()
+	if applicationID == "" || instanceIndex == "" {
+		return
+	}
+
+	if gauge := envelope.GetGauge(); gauge != nil {
+		c.observeGauge(applicationID, instanceIndex, gauge)
+	}
+	if event := envelope.GetEvent(); event != nil {
+		c.observeEvent(applicationID, instanceIndex, event)
+	}
+}
+
+// observeGauge updates the rolling window's CPU/memory/disk metrics from a
+// gauge envelope. Every gauge marks the instance RUNNING, including one
+// seeded as STARTING or previously marked CRASHED; observeEvent is what
+// moves it to CRASHED.
+func (c *InstancesCollector) observeGauge(applicationID string, instanceIndex string, gauge *loggregator_v2.Gauge) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	snapshot := c.snapshotFor(applicationID, instanceIndex)
+	snapshot.state = "RUNNING"
+	snapshot.lastSeen = time.Now()
+
+	if metric, ok := gauge.GetMetrics()["cpu"]; ok {
+		snapshot.cpuPercentage = metric.GetValue()
+	}
+	if metric, ok := gauge.GetMetrics()["memory"]; ok {
+		snapshot.memoryBytes = metric.GetValue()
+	}
+	if metric, ok := gauge.GetMetrics()["disk"]; ok {
+		snapshot.diskBytes = metric.GetValue()
+	}
+}
+
+// observeEvent marks an instance CRASHED on an "app.crash" event - the only
+// signal the firehose gives for instance state, since gauge envelopes carry
+// none.
+func (c *InstancesCollector) observeEvent(applicationID string, instanceIndex string, event *loggregator_v2.Event) {
+	if event.GetTitle() != "app.crash" {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	snapshot := c.snapshotFor(applicationID, instanceIndex)
+	snapshot.state = "CRASHED"
+	snapshot.lastSeen = time.Now()
+}
+
+// snapshotFor returns the existing rolling-window entry for (applicationID,
+// instanceIndex), creating one looked up against the applications cache if
+// this is the first envelope seen for it. Callers must hold c.mu.
+func (c *InstancesCollector) snapshotFor(applicationID string, instanceIndex string) *instanceSnapshot {
+	key := applicationID + "/" + instanceIndex
+
+	snapshot, ok := c.instances[key]
+	if !ok {
+		organizationName, spaceName := c.lookupApplicationLocation(applicationID)
+		snapshot = &instanceSnapshot{
+			applicationID:    applicationID,
+			instanceIndex:    instanceIndex,
+			organizationName: organizationName,
+			spaceName:        spaceName,
+		}
+		c.instances[key] = snapshot
+	}
+
+	return snapshot
+}
+
+// lookupApplicationLocation resolves an application's organization/space
+// names from the shared applications Cache. Loggregator v2 envelopes carry
+// neither - only the source application's GUID and the instance index.
+func (c *InstancesCollector) lookupApplicationLocation(applicationID string) (organizationName string, spaceName string) {
+	cached, err := c.cache.Get(cacheResourceApplications)
+	if err != nil {
+		return "", ""
+	}
+
+	applications, _ := cached.([]*application)
+	for _, app := range applications {
+		if app.app.Guid == applicationID {
+			return app.org.Name, app.space.Name
+		}
+	}
+
+	return "", ""
+}
+
+// reconcileDesiredInstances periodically seeds a STARTING entry for every
+// desired instance index of every STARTED application that the firehose
+// hasn't reported an envelope for yet. The firehose itself has no signal
+// for "starting" - only gauges (RUNNING) and an "app.crash" event
+// (CRASHED) - so without this, an instance that hasn't sent its first
+// gauge simply wouldn't exist in the rolling window at all. It reads the
+// same shared applications Cache lookupApplicationLocation does, for the
+// desired instance count `/v3/apps` enrichment now populates.
+func (c *InstancesCollector) reconcileDesiredInstances() {
+	ticker := time.NewTicker(c.window)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		c.seedDesiredInstances()
+	}
+}
+
+// seedDesiredInstances runs one reconciliation pass: for every STARTED
+// application, it creates a STARTING snapshot for each desired instance
+// index that doesn't already have one, leaving existing snapshots (RUNNING
+// or CRASHED) untouched. An existing STARTING placeholder has its lastSeen
+// renewed, so expireStaleInstances doesn't drop it while its application
+// still desires it.
+func (c *InstancesCollector) seedDesiredInstances() {
+	cached, err := c.cache.Get(cacheResourceApplications)
+	if err != nil {
+		return
+	}
+
+	applications, _ := cached.([]*application)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, app := range applications {
+		if app.app.State != "STARTED" {
+			continue
+		}
+
+		for index := 0; index < app.app.Instances; index++ {
+			key := app.app.Guid + "/" + strconv.Itoa(index)
+			if existing, ok := c.instances[key]; ok {
+				if existing.state == "STARTING" {
+					existing.lastSeen = time.Now()
+				}
+				continue
+			}
+
+			c.instances[key] = &instanceSnapshot{
+				applicationID:    app.app.Guid,
+				instanceIndex:    strconv.Itoa(index),
+				organizationName: app.org.Name,
+				spaceName:        app.space.Name,
+				state:            "STARTING",
+				lastSeen:         time.Now(),
+			}
+		}
+	}
+}
+
+// expireStaleInstances periodically drops instances whose last envelope is
+// older than the configured window, so a crashed or evacuated instance
+// disappears from the metrics instead of reporting stale data forever. It
+// ticks on its own, shorter cadence rather than reusing c.window: a snapshot
+// seeded by reconcileDesiredInstances gets lastSeen set to the moment it's
+// created, so on a shared c.window cadence the next expiry check landed
+// almost exactly at the `time.Since(lastSeen) > c.window` threshold, and
+// every freshly-seeded STARTING placeholder flapped between expired and
+// re-seeded each cycle instead of settling.
+func (c *InstancesCollector) expireStaleInstances() {
+	ticker := time.NewTicker(c.expireInterval())
+	defer ticker.Stop()
+
+	for range ticker.C {
+		c.mu.Lock()
+		for key, snapshot := range c.instances {
+			if time.Since(snapshot.lastSeen) > c.window {
+				delete(c.instances, key)
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+// expireInterval ticks expiry checks several times per c.window instead of
+// once per c.window, so a snapshot's age is re-evaluated well ahead of its
+// actual expiry rather than once, right at the threshold.
+func (c *InstancesCollector) expireInterval() time.Duration {
+	const minExpireInterval = time.Second
+
+	interval := c.window / 4
+	if interval < minExpireInterval {
+		interval = minExpireInterval
+	}
+
+	return interval
+}
+
+// Collect emits a MustNewConstMetric per instance straight to ch instead of
+// mutating GaugeVecs held on the struct, the same lock-free pattern used by
+// ApplicationsCollector: no Reset() racing against observe() appending to
+// the rolling window from the firehose goroutine, and no per-scrape
+// label-value map allocation.
+func (c *InstancesCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.RLock()
+	snapshots := make([]*instanceSnapshot, 0, len(c.instances))
+	for _, snapshot := range c.instances {
+		snapshots = append(snapshots, snapshot)
+	}
+	c.mu.RUnlock()
+
+	for _, snapshot := range snapshots {
+		ch <- prometheus.MustNewConstMetric(
+			c.applicationInstanceCPUPercentageDesc,
+			prometheus.GaugeValue,
+			snapshot.cpuPercentage,
+			snapshot.applicationID,
+			snapshot.instanceIndex,
+			snapshot.organizationName,
+			snapshot.spaceName,
+		)
+
+		ch <- prometheus.MustNewConstMetric(
+			c.applicationInstanceMemoryBytesDesc,
+			prometheus.GaugeValue,
+			snapshot.memoryBytes,
+			snapshot.applicationID,
+			snapshot.instanceIndex,
+			snapshot.organizationName,
+			snapshot.spaceName,
+		)
+
+		ch <- prometheus.MustNewConstMetric(
+			c.applicationInstanceDiskBytesDesc,
+			prometheus.GaugeValue,
+			snapshot.diskBytes,
+			snapshot.applicationID,
+			snapshot.instanceIndex,
+			snapshot.organizationName,
+			snapshot.spaceName,
+		)
+
+		ch <- prometheus.MustNewConstMetric(
+			c.applicationInstanceStateDesc,
+			prometheus.GaugeValue,
+			float64(1),
+			snapshot.applicationID,
+			snapshot.instanceIndex,
+			snapshot.organizationName,
+			snapshot.spaceName,
+			snapshot.state,
+		)
+	}
+}
+
+func (c *InstancesCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.applicationInstanceCPUPercentageDesc
+	ch <- c.applicationInstanceMemoryBytesDesc
+	ch <- c.applicationInstanceDiskBytesDesc
+	ch <- c.applicationInstanceStateDesc
+}
@@ -0,0 +1,142 @@
+package collectors
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricsRecorder buffers a response so that filterMetricsHandler can drop
+// unwanted lines before writing anything to the real http.ResponseWriter.
+type metricsRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newMetricsRecorder() *metricsRecorder {
+	return &metricsRecorder{header: make(http.Header), status: http.StatusOK}
+}
+
+func (rec *metricsRecorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *metricsRecorder) Write(b []byte) (int, error) {
+	return rec.body.Write(b)
+}
+
+func (rec *metricsRecorder) WriteHeader(status int) {
+	rec.status = status
+}
+
+// NewV3Handler builds the http.Handler served at /metrics/v3/PATH. PATH
+// selects one or more sub-groups (e.g. `applications`, `organizations`); a
+// parent path, or no path at all, returns the union of every group
+// registered in V3Registry. A repeated `filter[]` query parameter further
+// restricts the response to metric families whose name contains one of the
+// given substrings.
+func NewV3Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		groups := v3GroupsFromPath(r.URL.Path)
+		filters := r.URL.Query()["filter[]"]
+
+		registry := prometheus.NewRegistry()
+		for _, collector := range V3Registry.Collectors(groups...) {
+			registry.MustRegister(collector)
+		}
+
+		// DisableCompression: filterMetricsHandler below needs the raw
+		// exposition text to split and match against, and Prometheus sends
+		// `Accept-Encoding: gzip` by default - letting promhttp compress
+		// would hand it gzipped bytes to split on "\n".
+		handler := promhttp.HandlerFor(registry, promhttp.HandlerOpts{DisableCompression: true})
+		if len(filters) > 0 {
+			handler = filterMetricsHandler(handler, filters)
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// v3GroupsFromPath extracts the sub-group names from a /metrics/v3/PATH
+// request path. The literal prefix `/metrics/v3` itself (with or without a
+// trailing slash) selects every group.
+func v3GroupsFromPath(path string) []V3Group {
+	path = strings.TrimPrefix(path, "/metrics/v3")
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return nil
+	}
+
+	segments := strings.Split(path, "/")
+	groups := make([]V3Group, 0, len(segments))
+	for _, segment := range segments {
+		if segment != "" {
+			groups = append(groups, V3Group(segment))
+		}
+	}
+
+	return groups
+}
+
+// filterMetricsHandler wraps an existing metrics handler and drops any
+// output line whose metric name does not contain one of the given filter
+// substrings. Comment lines (`# HELP`, `# TYPE`) are matched the same way so
+// that the exposition format stays self-describing for the metrics that
+// remain.
+func filterMetricsHandler(next http.Handler, filters []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := newMetricsRecorder()
+		next.ServeHTTP(recorder, r)
+
+		for key, values := range recorder.Header() {
+			// Content-Length and Content-Encoding describe recorder.body,
+			// not the filtered body this handler is about to write -
+			// forwarding them verbatim would mislabel a plain-text body
+			// with a stale length or a gzip encoding it no longer has.
+			if key == "Content-Length" || key == "Content-Encoding" {
+				continue
+			}
+			for _, value := range values {
+				w.Header().Add(key, value)
+			}
+		}
+		w.WriteHeader(recorder.status)
+
+		for _, line := range strings.Split(recorder.body.String(), "\n") {
+			if line == "" {
+				continue
+			}
+			if metricNameMatches(line, filters) {
+				w.Write([]byte(line + "\n"))
+			}
+		}
+	})
+}
+
+// metricNameMatches reports whether the metric (or HELP/TYPE comment) name
+// found at the start of an exposition-format line contains at least one of
+// the filter substrings.
+func metricNameMatches(line string, filters []string) bool {
+	name := line
+	if strings.HasPrefix(line, "# HELP ") || strings.HasPrefix(line, "# TYPE ") {
+		fields := strings.SplitN(line, " ", 4)
+		if len(fields) >= 3 {
+			name = fields[2]
+		}
+	} else if idx := strings.IndexAny(line, " {"); idx != -1 {
+		name = line[:idx]
+	}
+
+	for _, filter := range filters {
+		if strings.Contains(name, filter) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,73 @@
+package collectors
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricNameMatches(t *testing.T) {
+	cases := []struct {
+		name    string
+		line    string
+		filters []string
+		want    bool
+	}{
+		{"HELP comment matches", `# HELP cf_application_info Labeled Cloud Foundry Application information.`, []string{"application"}, true},
+		{"TYPE comment matches", `# TYPE cf_application_info gauge`, []string{"application"}, true},
+		{"metric line with labels matches", `cf_application_info{application_id="1"} 1`, []string{"application"}, true},
+		{"metric line without labels matches", `cf_up 1`, []string{"up"}, true},
+		{"no filter matches", `cf_application_info{application_id="1"} 1`, []string{"organization"}, false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := metricNameMatches(tc.line, tc.filters); got != tc.want {
+				t.Errorf("metricNameMatches(%q, %v) = %v, want %v", tc.line, tc.filters, got, tc.want)
+			}
+		})
+	}
+}
+
+// TestFilterMetricsHandlerDropsUnmatchedLines confirms filterMetricsHandler
+// keeps only lines matching the filter and strips the Content-Length/
+// Content-Encoding headers describing the unfiltered body.
+func TestFilterMetricsHandlerDropsUnmatchedLines(t *testing.T) {
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Length", "999")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("# HELP cf_application_info info\n" +
+			"# TYPE cf_application_info gauge\n" +
+			"cf_application_info{application_id=\"1\"} 1\n" +
+			"# HELP cf_organization_info info\n" +
+			"# TYPE cf_organization_info gauge\n" +
+			"cf_organization_info{organization_id=\"1\"} 1\n"))
+	})
+
+	handler := filterMetricsHandler(inner, []string{"application"})
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics/v3", nil)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	body := rec.Body.String()
+	if !strings.Contains(body, "cf_application_info") {
+		t.Errorf("expected the matching metric to survive filtering, got body %q", body)
+	}
+	if strings.Contains(body, "cf_organization_info") {
+		t.Errorf("expected the non-matching metric to be dropped, got body %q", body)
+	}
+
+	if rec.Header().Get("Content-Length") != "" {
+		t.Errorf("expected Content-Length to be stripped, since the filtered body has a different length")
+	}
+	if rec.Header().Get("Content-Encoding") != "" {
+		t.Errorf("expected Content-Encoding to be stripped, since the filtered body is plain text")
+	}
+	if rec.Header().Get("Content-Type") != "text/plain" {
+		t.Errorf("expected other headers to pass through unchanged")
+	}
+}
@@ -0,0 +1,98 @@
+package collectors
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// V3Group identifies one of the sub-endpoints exposed under /metrics/v3.
+type V3Group string
+
+const (
+	V3GroupApplications   V3Group = "applications"
+	V3GroupInstances      V3Group = "instances"
+	V3GroupOrganizations  V3Group = "organizations"
+	V3GroupSpaces         V3Group = "spaces"
+	V3GroupRoutes         V3Group = "routes"
+	V3GroupServices       V3Group = "services"
+	V3GroupServiceBinds   V3Group = "service_bindings"
+	V3GroupBuildpacks     V3Group = "buildpacks"
+	V3GroupSecurityGroups V3Group = "security_groups"
+	V3GroupEvents         V3Group = "events"
+)
+
+// v3Registry is the central, process-wide registry that every collector in
+// this package registers itself into. It lets the `/metrics/v3/PATH` HTTP
+// handler build a `prometheus.Registry` scoped to the groups (and, within a
+// group, the metric names) that were requested, instead of always paying
+// the cost of collecting every resource type.
+type v3Registry struct {
+	mu     sync.RWMutex
+	groups map[V3Group][]prometheus.Collector
+}
+
+// V3Registry is the package-level instance collectors register with from
+// their constructors.
+var V3Registry = &v3Registry{
+	groups: make(map[V3Group][]prometheus.Collector),
+}
+
+// Register associates the given collectors with a V3Group so that they are
+// included when that group (or the root, parent path) is scraped via
+// /metrics/v3.
+func (r *v3Registry) Register(group V3Group, collectors ...prometheus.Collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.groups[group] = append(r.groups[group], collectors...)
+}
+
+// Groups returns the names of every group that has at least one collector
+// registered, sorted for stable output.
+func (r *v3Registry) Groups() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	groups := make([]string, 0, len(r.groups))
+	for group := range r.groups {
+		groups = append(groups, string(group))
+	}
+	sort.Strings(groups)
+
+	return groups
+}
+
+// Collectors returns the collectors registered for the given groups, each at
+// most once even if it was registered under more than one of them (or, with
+// a nil/empty `groups` selecting every registered group, registered under
+// more than one group overall) - registry.MustRegister panics on a
+// duplicate, so a scrape spanning groups that share a collector must not
+// hand it back twice. A nil or empty `groups` selects every registered
+// group, matching a parent path (or empty PATH) scrape of /metrics/v3.
+func (r *v3Registry) Collectors(groups ...V3Group) []prometheus.Collector {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	selectedGroups := groups
+	if len(selectedGroups) == 0 {
+		for group := range r.groups {
+			selectedGroups = append(selectedGroups, group)
+		}
+	}
+
+	seen := make(map[prometheus.Collector]bool)
+	var collectors []prometheus.Collector
+	for _, group := range selectedGroups {
+		for _, collector := range r.groups[group] {
+			if seen[collector] {
+				continue
+			}
+			seen[collector] = true
+			collectors = append(collectors, collector)
+		}
+	}
+
+	return collectors
+}